@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/exp/slog"
+	"gopkg.in/yaml.v3"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var serviceUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "tsnsrv_config_service_up",
+	Help: "Whether a service declared in the -config file is currently running (1) or stopped (0).",
+}, []string{"name"})
+
+// ServiceConfig is a single named service entry in a multi-service
+// configuration file. It embeds the same options as the CLI flags, plus the
+// destination URL that is otherwise taken from the positional argument.
+type ServiceConfig struct {
+	TailnetSrv `yaml:",inline"`
+	ToURL      string `yaml:"toURL"`
+}
+
+// MultiConfig is the top-level shape of a -config file: a set of named
+// services that should all run out of the same tsnsrv process.
+type MultiConfig struct {
+	Services map[string]ServiceConfig `yaml:"services"`
+}
+
+func loadConfig(path string) (*MultiConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open config %v: %w", path, err)
+	}
+	defer f.Close()
+	var cfg MultiConfig
+	if err := yaml.NewDecoder(f).Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("could not parse config %v: %w", path, err)
+	}
+	for name, svc := range cfg.Services {
+		if svc.Name == "" {
+			svc.Name = name
+			cfg.Services[name] = svc
+		}
+	}
+	return &cfg, nil
+}
+
+func (c ServiceConfig) validated() (*validTailnetSrv, error) {
+	s := c.TailnetSrv
+	var args []string
+	if c.ToURL != "" {
+		args = []string{c.ToURL}
+	}
+	return s.validate(args)
+}
+
+// runningService tracks the goroutine serving a single configured service so
+// that a reload can cancel the ones that disappeared or changed. generation
+// is bumped every time a service with this name is (re)started, so a stale
+// goroutine from a since-replaced instance can tell it's no longer current
+// and must not clobber the replacement's serviceUp value.
+type runningService struct {
+	cfg        ServiceConfig
+	cancel     context.CancelFunc
+	generation uint64
+}
+
+// runConfig runs every service declared in the file at path. On SIGHUP it
+// re-reads the file, stops services that were removed, restarts services
+// whose entry changed and leaves unchanged services running. Each
+// service gets its own tsnet.Server, run concurrently in its own goroutine;
+// an unrecoverable error in one service does not bring down the others
+// unless the top-level context is also canceled.
+func runConfig(ctx context.Context, path string) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var mu sync.Mutex
+	running := map[string]*runningService{}
+	generation := map[string]uint64{}
+	var wg sync.WaitGroup
+	var errsMu sync.Mutex
+	var errs []error
+
+	start := func(name string, cfg ServiceConfig) error {
+		valid, err := cfg.validated()
+		if err != nil {
+			return fmt.Errorf("invalid service %v in config: %w", name, err)
+		}
+		svcCtx, cancel := context.WithCancel(ctx)
+		mu.Lock()
+		generation[name]++
+		gen := generation[name]
+		running[name] = &runningService{cfg: cfg, cancel: cancel, generation: gen}
+		mu.Unlock()
+		serviceUp.WithLabelValues(name).Set(1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				mu.Lock()
+				current, ok := running[name]
+				isCurrent := ok && current.generation == gen
+				mu.Unlock()
+				if isCurrent {
+					serviceUp.WithLabelValues(name).Set(0)
+				}
+			}()
+			if err := valid.run(svcCtx); err != nil && svcCtx.Err() == nil {
+				slog.Error("service exited", "name", name, "error", err)
+				errsMu.Lock()
+				errs = append(errs, fmt.Errorf("service %v: %w", name, err))
+				errsMu.Unlock()
+			}
+		}()
+		return nil
+	}
+
+	reload := func() error {
+		cfg, err := loadConfig(path)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		var stale []string
+		for name := range running {
+			if _, ok := cfg.Services[name]; !ok {
+				stale = append(stale, name)
+			}
+		}
+		mu.Unlock()
+		for _, name := range stale {
+			slog.Info("stopping removed service", "name", name)
+			mu.Lock()
+			running[name].cancel()
+			delete(running, name)
+			mu.Unlock()
+			serviceUp.DeleteLabelValues(name)
+		}
+		for name, svc := range cfg.Services {
+			mu.Lock()
+			existing, ok := running[name]
+			mu.Unlock()
+			if ok && sameService(existing.cfg, svc) {
+				continue
+			}
+			if ok {
+				slog.Info("restarting changed service", "name", name)
+				existing.cancel()
+			} else {
+				slog.Info("starting service", "name", name)
+			}
+			if err := start(name, svc); err != nil {
+				slog.Error("could not start service", "name", name, "error", err)
+			}
+		}
+		return nil
+	}
+
+	if err := reload(); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				slog.Info("reloading config", "path", path)
+				if err := reload(); err != nil {
+					slog.Error("could not reload config", "error", err)
+				}
+			}
+		}
+	}()
+
+	wg.Wait()
+	errsMu.Lock()
+	defer errsMu.Unlock()
+	return errors.Join(errs...)
+}
+
+func sameService(a, b ServiceConfig) bool {
+	return fmt.Sprintf("%+v", a) == fmt.Sprintf("%+v", b)
+}
+
+func isConfigFlag(args []string) (string, bool) {
+	for i, a := range args {
+		if a == "-config" || a == "--config" {
+			if i+1 < len(args) {
+				return args[i+1], true
+			}
+		}
+		if strings.HasPrefix(a, "-config=") {
+			return strings.TrimPrefix(a, "-config="), true
+		}
+		if strings.HasPrefix(a, "--config=") {
+			return strings.TrimPrefix(a, "--config="), true
+		}
+	}
+	return "", false
+}
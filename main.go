@@ -52,12 +52,29 @@ type TailnetSrv struct {
 	WhoisTimeout                          time.Duration
 	SuppressWhois                         bool
 	PrometheusAddr                        string
+	ConfigFile                            string
+	Mode                                  string
+	ProxyProtocol                         string
+	OIDCIssuer                            string
+	OIDCClientID                          string
+	OIDCClientSecretFile                  string
+	OIDCRedirectURL                       string
+	OIDCAllowedGroups                     prefixes
+	TLSMode                               string
+	ACMEChallenge                         string
+	TLSHostname                           string
+	TLSCertFile                           string
+	TLSKeyFile                            string
+	StateStore                            string
 }
 
 type validTailnetSrv struct {
 	TailnetSrv
 	DestURL *url.URL
 	client  *tailscale.LocalClient
+	// TCPACLHook, set by embedders of tsnsrv only (there is no CLI flag for
+	// it), lets -mode=tcp reject connections based on WhoIs before dialing.
+	TCPACLHook TCPACLHook
 }
 
 func tailnetSrvFromArgs(args []string) (*validTailnetSrv, *ffcli.Command, error) {
@@ -76,11 +93,25 @@ func tailnetSrvFromArgs(args []string) (*validTailnetSrv, *ffcli.Command, error)
 	fs.Var(&s.AllowedPrefixes, "prefix", "Allowed URL prefixes; if none is set, all prefixes are allowed")
 	fs.BoolVar(&s.StripPrefix, "stripPrefix", true, "Strip prefixes that matched; best set to false if allowing multiple prefixes")
 	fs.StringVar(&s.StateDir, "stateDir", "", "Directory containing the persistent tailscale status files.")
-	fs.StringVar(&s.AuthkeyPath, "authkeyPath", "", "File containing a tailscale auth key. Key is assumed to be in $TS_AUTHKEY in absence of this option.")
+	fs.StringVar(&s.AuthkeyPath, "authkeyPath", "", "File containing a tailscale auth key, or a secret URL (env://VAR, file://<path>, kube://<secret-name>[/<key>], file+aes://<path>?key=...). Key is assumed to be in $TS_AUTHKEY in absence of this option.")
 	fs.BoolVar(&s.InsecureHTTPS, "insecureHTTPS", false, "Disable TLS certificate validation on upstream")
 	fs.DurationVar(&s.WhoisTimeout, "whoisTimeout", 1*time.Second, "Maximum amount of time to spend looking up client identities")
 	fs.BoolVar(&s.SuppressWhois, "suppressWhois", false, "Do not set X-Tailscale-User-* headers in upstream requests")
 	fs.StringVar(&s.PrometheusAddr, "prometheusAddr", ":9099", "Serve prometheus metrics from this address. Empty string to disable.")
+	fs.StringVar(&s.ConfigFile, "config", "", "Run the services declared in this YAML config file instead of a single service from flags/args. Reloaded on SIGHUP.")
+	fs.StringVar(&s.Mode, "mode", "http", "Proxy mode: 'http' for a reverse HTTP proxy, 'tcp' for a raw TCP/L4 proxy to -downstreamTCPAddr or -downstreamUnixAddr.")
+	fs.StringVar(&s.ProxyProtocol, "proxyProtocol", "", "Emit a HAProxy PROXY protocol header ('v1' or 'v2') carrying the real tailnet client address on every new upstream connection.")
+	fs.StringVar(&s.OIDCIssuer, "oidcIssuer", "", "OIDC issuer URL. When set, gate the reverse proxy behind an OIDC login (for funnel services, where tailnet whois is not available).")
+	fs.StringVar(&s.OIDCClientID, "oidcClientID", "", "OIDC client ID.")
+	fs.StringVar(&s.OIDCClientSecretFile, "oidcClientSecretFile", "", "File containing the OIDC client secret.")
+	fs.StringVar(&s.OIDCRedirectURL, "oidcRedirectURL", "", "Externally reachable URL of this service's OIDC callback, e.g. https://my-service.example.com/oauth2/callback. Must be registered with the OIDC provider and must end in /oauth2/callback.")
+	fs.Var(&s.OIDCAllowedGroups, "oidcAllowedGroups", "Group that is allowed to authenticate via OIDC; can be repeated. If none is set, any authenticated user is allowed.")
+	fs.StringVar(&s.TLSMode, "tls", "tsnet", "TLS provisioning: 'tsnet' for the Tailscale-issued *.ts.net cert, 'letsencrypt' for an ACME-issued cert on -tlsHostname, or 'file' for a PEM cert/key pair.")
+	fs.StringVar(&s.ACMEChallenge, "acmeChallenge", "tls-alpn-01", "ACME challenge type to use with -tls=letsencrypt: 'http-01' or 'tls-alpn-01'.")
+	fs.StringVar(&s.TLSHostname, "tlsHostname", "", "Hostname to request a certificate for with -tls=letsencrypt.")
+	fs.StringVar(&s.TLSCertFile, "tlsCertFile", "", "PEM certificate file to use with -tls=file.")
+	fs.StringVar(&s.TLSKeyFile, "tlsKeyFile", "", "PEM key file to use with -tls=file.")
+	fs.StringVar(&s.StateStore, "stateStore", "", "Where to persist tsnet state: 'dir://<path>' (default, same as -stateDir), 'mem://' for ephemeral in-memory state, 'kube://<secret-name>' for a Kubernetes Secret, or 'file+aes://<path>?key=env:VAR' for an AES-encrypted file. Overrides -stateDir.")
 
 	root := &ffcli.Command{
 		ShortUsage: "tsnsrv -name <serviceName> [flags] <toURL>",
@@ -111,24 +142,98 @@ func (s *TailnetSrv) validate(args []string) (*validTailnetSrv, error) {
 	if !s.Funnel && s.FunnelOnly {
 		errs = append(errs, errors.New("-funnel is required if -funnelOnly is set."))
 	}
+	if s.Mode == "" {
+		s.Mode = "http"
+	}
+	if s.Mode != "http" && s.Mode != "tcp" {
+		errs = append(errs, fmt.Errorf("unknown -mode %#v, must be 'http' or 'tcp'", s.Mode))
+	}
+	if s.Mode == "tcp" && s.DownstreamTCPAddr == "" && s.DownstreamUnixAddr == "" {
+		errs = append(errs, errors.New("-mode=tcp requires -downstreamTCPAddr or -downstreamUnixAddr"))
+	}
+	if s.ProxyProtocol != "" && s.ProxyProtocol != "v1" && s.ProxyProtocol != "v2" {
+		errs = append(errs, fmt.Errorf("unknown -proxyProtocol %#v, must be 'v1' or 'v2'", s.ProxyProtocol))
+	}
+	if s.ProxyProtocol != "" && s.DownstreamTCPAddr == "" && s.DownstreamUnixAddr == "" {
+		errs = append(errs, errors.New("-proxyProtocol requires -downstreamTCPAddr or -downstreamUnixAddr"))
+	}
+	if s.OIDCIssuer != "" && (s.OIDCClientID == "" || s.OIDCClientSecretFile == "") {
+		errs = append(errs, errors.New("-oidcIssuer requires -oidcClientID and -oidcClientSecretFile"))
+	}
+	if s.OIDCIssuer != "" && s.StateDir == "" {
+		errs = append(errs, errors.New("-oidcIssuer requires -stateDir to store sessions in"))
+	}
+	if s.OIDCIssuer != "" && s.ServePlaintext {
+		errs = append(errs, errors.New("-oidcIssuer requires TLS: the session cookie is Secure-only and won't be sent back over plaintext HTTP"))
+	}
+	if s.OIDCIssuer != "" && s.OIDCRedirectURL == "" {
+		errs = append(errs, errors.New("-oidcIssuer requires -oidcRedirectURL, the externally reachable URL of this service's /oauth2/callback"))
+	}
+	if s.OIDCIssuer != "" && s.OIDCRedirectURL != "" && !strings.HasSuffix(s.OIDCRedirectURL, oidcCallbackPath) {
+		errs = append(errs, fmt.Errorf("-oidcRedirectURL must end in %v", oidcCallbackPath))
+	}
+	if s.TLSMode == "" {
+		s.TLSMode = "tsnet"
+	}
+	switch s.TLSMode {
+	case "tsnet":
+	case "letsencrypt":
+		if s.TLSHostname == "" {
+			errs = append(errs, errors.New("-tls=letsencrypt requires -tlsHostname"))
+		}
+		if s.StateDir == "" {
+			errs = append(errs, errors.New("-tls=letsencrypt requires -stateDir to cache certificates in"))
+		}
+		if s.ACMEChallenge != "http-01" && s.ACMEChallenge != "tls-alpn-01" {
+			errs = append(errs, fmt.Errorf("unknown -acmeChallenge %#v, must be 'http-01' or 'tls-alpn-01'", s.ACMEChallenge))
+		}
+	case "file":
+		if s.TLSCertFile == "" || s.TLSKeyFile == "" {
+			errs = append(errs, errors.New("-tls=file requires -tlsCertFile and -tlsKeyFile"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown -tls mode %#v, must be 'tsnet', 'letsencrypt' or 'file'", s.TLSMode))
+	}
+	if s.TLSMode != "tsnet" && s.ServePlaintext {
+		errs = append(errs, errors.New("-tls is mutually exclusive with -plaintext"))
+	}
+	if s.TLSMode != "tsnet" && s.Funnel {
+		errs = append(errs, errors.New("-tls=letsencrypt/file is not supported with -funnel, which terminates TLS itself; serve on a non-tailnet -listenAddr instead"))
+	}
+	if s.StateStore != "" && !strings.Contains(s.StateStore, "://") {
+		errs = append(errs, fmt.Errorf("-stateStore %#v is not a URL; expected a scheme like dir://, mem://, kube:// or file+aes://", s.StateStore))
+	}
 
-	if len(args) != 1 {
+	if s.Mode != "tcp" && len(args) != 1 {
 		errs = append(errs, errors.New("tsnsrv requires a destination URL."))
 	}
 	if len(errs) > 0 {
 		return nil, errors.Join(errs...)
 	}
 
-	destURL, err := url.Parse(args[0])
-	if err != nil {
-		return nil, fmt.Errorf("invalid destination URL %#v: %w", args[0], err)
+	var destURL *url.URL
+	if len(args) == 1 {
+		var err error
+		destURL, err = url.Parse(args[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid destination URL %#v: %w", args[0], err)
+		}
 	}
 
 	valid := validTailnetSrv{TailnetSrv: *s, DestURL: destURL}
 	return &valid, nil
 }
 
+// authkeyFromFile reads an auth key from a plain file path, or, if path is a
+// URL, from a secret URL as resolved by resolveSecretURL (env://VAR,
+// file://<path>, or the kube://<secret-name> and file+aes://<path>?key=...
+// backends that -stateStore also uses). This lets
+// -authkeyPath be satisfied by a Kubernetes secret projection instead of a
+// path on disk.
 func authkeyFromFile(path string) (string, error) {
+	if strings.Contains(path, "://") {
+		return resolveSecretURL(path)
+	}
 	f, err := os.Open(path)
 	if err != nil {
 		return "", err
@@ -146,6 +251,14 @@ func (s *validTailnetSrv) run(ctx context.Context) error {
 		Ephemeral:  s.Ephemeral,
 		ControlURL: os.Getenv("TS_URL"),
 	}
+	if s.StateStore != "" {
+		store, err := buildStateStore(s.StateStore)
+		if err != nil {
+			return fmt.Errorf("could not set up -stateStore %v: %w", s.StateStore, err)
+		}
+		srv.Dir = ""
+		srv.Store = store
+	}
 	if s.AuthkeyPath != "" {
 		var err error
 		srv.AuthKey, err = authkeyFromFile(s.AuthkeyPath)
@@ -155,9 +268,10 @@ func (s *validTailnetSrv) run(ctx context.Context) error {
 				"error", err)
 		}
 	}
-	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	runCtx := ctx
+	connectCtx, cancel := context.WithTimeout(ctx, s.Timeout)
 	defer cancel()
-	status, err := srv.Up(ctx)
+	status, err := srv.Up(connectCtx)
 	if err != nil {
 		return fmt.Errorf("could not connect to tailnet: %w", err)
 	}
@@ -167,10 +281,32 @@ func (s *validTailnetSrv) run(ctx context.Context) error {
 			"error", err,
 		)
 	}
-	l, err := s.listen(srv)
+	l, err := s.listen(runCtx, srv)
 	if err != nil {
 		return fmt.Errorf("could not listen: %w", err)
 	}
+	go func() {
+		<-runCtx.Done()
+		l.Close()
+	}()
+
+	err = s.setupPrometheus(srv)
+	if err != nil {
+		slog.Error("Could not setup prometheus listener", "error", err)
+	}
+
+	if s.Mode == "tcp" {
+		slog.Info("Serving TCP",
+			"name", s.Name,
+			"tailscaleIPs", status.TailscaleIPs,
+			"listenAddr", s.ListenAddr,
+			"downstreamTCPAddr", s.DownstreamTCPAddr,
+			"downstreamUnixAddr", s.DownstreamUnixAddr,
+			"funnel", s.Funnel,
+			"funnelOnly", s.FunnelOnly,
+		)
+		return fmt.Errorf("while serving tcp: %w", s.runTCP(runCtx, l))
+	}
 
 	dial := srv.Dial
 	if s.DownstreamTCPAddr != "" {
@@ -183,15 +319,24 @@ func (s *validTailnetSrv) run(ctx context.Context) error {
 			return d.DialContext(ctx, "unix", s.DownstreamUnixAddr)
 		}
 	}
+	if s.ProxyProtocol != "" {
+		dial = s.proxyProtocolDialer(dial)
+	}
 	transport := &http.Transport{DialContext: dial}
+	if s.ProxyProtocol != "" {
+		transport.DisableKeepAlives = true
+	}
 	if s.InsecureHTTPS {
 		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	}
 	mux := s.mux(transport)
-
-	err = s.setupPrometheus(srv)
-	if err != nil {
-		slog.Error("Could not setup prometheus listener", "error", err)
+	var handler http.Handler = mux
+	if s.OIDCIssuer != "" {
+		gw, err := newOIDCGateway(runCtx, s)
+		if err != nil {
+			return fmt.Errorf("could not set up OIDC gateway: %w", err)
+		}
+		handler = gw.wrap(mux)
 	}
 
 	slog.Info("Serving",
@@ -204,10 +349,23 @@ func (s *validTailnetSrv) run(ctx context.Context) error {
 		"funnel", s.Funnel,
 		"funnelOnly", s.FunnelOnly,
 	)
-	return fmt.Errorf("while serving: %w", http.Serve(l, mux))
+	httpSrv := &http.Server{Handler: handler}
+	if s.ProxyProtocol != "" {
+		httpSrv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, remoteAddrContextKey{}, c.RemoteAddr())
+		}
+	}
+	return fmt.Errorf("while serving: %w", httpSrv.Serve(l))
 }
 
-func (s *TailnetSrv) listen(srv *tsnet.Server) (net.Listener, error) {
+func (s *TailnetSrv) listen(ctx context.Context, srv *tsnet.Server) (net.Listener, error) {
+	if s.TLSMode != "" && s.TLSMode != "tsnet" {
+		raw, err := s.rawListen()
+		if err != nil {
+			return nil, err
+		}
+		return s.wrapExternalTLS(ctx, raw)
+	}
 	if s.Funnel {
 		opts := []tsnet.FunnelOption{}
 		if s.FunnelOnly {
@@ -221,6 +379,17 @@ func (s *TailnetSrv) listen(srv *tsnet.Server) (net.Listener, error) {
 	}
 }
 
+// rawListen returns the plain, non-TLS listener that -tls=letsencrypt and
+// -tls=file wrap themselves. It binds a real host-network socket rather than
+// tsnet's virtual tailnet listener, since the whole point of these modes is
+// serving a custom apex domain to the public internet rather than the
+// Tailscale-issued *.ts.net cert. Funnel always terminates TLS itself
+// upstream of us, so it is not combined with these modes; see the check in
+// validate.
+func (s *TailnetSrv) rawListen() (net.Listener, error) {
+	return net.Listen("tcp", s.ListenAddr)
+}
+
 func (s *validTailnetSrv) setupPrometheus(srv *tsnet.Server) error {
 	if s.PrometheusAddr == "" {
 		return nil
@@ -239,6 +408,12 @@ func (s *validTailnetSrv) setupPrometheus(srv *tsnet.Server) error {
 }
 
 func main() {
+	if path, ok := isConfigFlag(os.Args[1:]); ok {
+		if err := runConfig(context.Background(), path); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	s, cmd, err := tailnetSrvFromArgs(os.Args[1:])
 	if err != nil {
 		log.Fatalf("Invalid CLI usage. Errors:\n%v\n\n%v", err, ffcli.DefaultUsageFunc(cmd))
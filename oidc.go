@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+	"golang.org/x/oauth2"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+const (
+	oidcCookieName   = "tsnsrv_oidc_session"
+	oidcSessionTTL   = 24 * time.Hour
+	oidcStateTTL     = 5 * time.Minute
+	oidcCallbackPath = "/oauth2/callback"
+	oidcLogoutPath   = "/oauth2/logout"
+	oidcHeaderEmail  = "X-Auth-Request-Email"
+	oidcHeaderGroups = "X-Auth-Request-Groups"
+)
+
+// oidcSession is what's persisted server-side (under StateDir) and referenced
+// by an opaque, HMAC-signed session ID in the user's cookie.
+type oidcSession struct {
+	Email  string    `json:"email"`
+	Groups []string  `json:"groups"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// oidcState is the short-lived, server-side record of an in-flight
+// Authorization Code + PKCE exchange, keyed by the OAuth2 "state" parameter.
+type oidcState struct {
+	Verifier    string    `json:"verifier"`
+	RedirectURL string    `json:"redirectURL"`
+	Expiry      time.Time `json:"expiry"`
+}
+
+// oidcGateway implements an OIDC Authorization Code + PKCE forward-auth
+// gateway in front of the reverse proxy, for services (typically funnel-only
+// ones) where the tailnet WhoIs headers are not available.
+type oidcGateway struct {
+	s             *validTailnetSrv
+	provider      *oidc.Provider
+	verifier      *oidc.IDTokenVerifier
+	oauth2Config  oauth2.Config
+	allowedGroups map[string]bool
+	hmacKey       []byte
+	dir           string
+}
+
+func newOIDCGateway(ctx context.Context, s *validTailnetSrv) (*oidcGateway, error) {
+	provider, err := oidc.NewProvider(ctx, s.OIDCIssuer)
+	if err != nil {
+		return nil, fmt.Errorf("could not discover OIDC issuer %v: %w", s.OIDCIssuer, err)
+	}
+	secret, err := authkeyFromFile(s.OIDCClientSecretFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read OIDC client secret: %w", err)
+	}
+	secret = strings.TrimSpace(secret)
+
+	dir := filepath.Join(s.StateDir, "oidc")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create OIDC state dir %v: %w", dir, err)
+	}
+	hmacKey, err := loadOrCreateHMACKey(filepath.Join(dir, "hmac.key"))
+	if err != nil {
+		return nil, fmt.Errorf("could not load OIDC session signing key: %w", err)
+	}
+
+	allowed := map[string]bool{}
+	for _, g := range s.OIDCAllowedGroups {
+		allowed[g] = true
+	}
+
+	return &oidcGateway{
+		s:        s,
+		provider: provider,
+		verifier: provider.Verifier(&oidc.Config{ClientID: s.OIDCClientID}),
+		oauth2Config: oauth2.Config{
+			ClientID:     s.OIDCClientID,
+			ClientSecret: secret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  s.OIDCRedirectURL,
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email", "groups"},
+		},
+		allowedGroups: allowed,
+		hmacKey:       hmacKey,
+		dir:           dir,
+	}, nil
+}
+
+func loadOrCreateHMACKey(path string) ([]byte, error) {
+	if key, err := os.ReadFile(path); err == nil {
+		return key, nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, key, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (g *oidcGateway) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case oidcCallbackPath:
+			g.serveCallback(w, r)
+			return
+		case oidcLogoutPath:
+			g.serveLogout(w, r)
+			return
+		}
+
+		session, err := g.sessionFromRequest(r)
+		if err != nil {
+			g.redirectToLogin(w, r)
+			return
+		}
+		r.Header.Set(oidcHeaderEmail, session.Email)
+		r.Header.Set(oidcHeaderGroups, strings.Join(session.Groups, ","))
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (g *oidcGateway) redirectToLogin(w http.ResponseWriter, r *http.Request) {
+	verifier := oauth2.GenerateVerifier()
+	state, err := randomID()
+	if err != nil {
+		http.Error(w, "could not start login", http.StatusInternalServerError)
+		return
+	}
+	if err := g.saveState(state, oidcState{
+		Verifier:    verifier,
+		RedirectURL: r.URL.String(),
+		Expiry:      time.Now().Add(oidcStateTTL),
+	}); err != nil {
+		slog.Error("could not persist oidc state", "error", err)
+		http.Error(w, "could not start login", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, g.oauth2Config.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier)), http.StatusFound)
+}
+
+func (g *oidcGateway) serveCallback(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	stateParam := r.URL.Query().Get("state")
+	state, err := g.loadState(stateParam)
+	if err != nil {
+		http.Error(w, "invalid or expired login attempt", http.StatusBadRequest)
+		return
+	}
+	token, err := g.oauth2Config.Exchange(ctx, r.URL.Query().Get("code"), oauth2.VerifierOption(state.Verifier))
+	if err != nil {
+		slog.Warn("oidc code exchange failed", "error", err)
+		http.Error(w, "login failed", http.StatusBadGateway)
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		http.Error(w, "login failed: no id_token in response", http.StatusBadGateway)
+		return
+	}
+	idToken, err := g.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		slog.Warn("oidc id_token verification failed", "error", err)
+		http.Error(w, "login failed", http.StatusBadGateway)
+		return
+	}
+	var claims struct {
+		Email  string   `json:"email"`
+		Groups []string `json:"groups"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		http.Error(w, "login failed: could not parse claims", http.StatusBadGateway)
+		return
+	}
+	if len(g.allowedGroups) > 0 && !g.anyGroupAllowed(claims.Groups) {
+		slog.Warn("oidc login denied: no allowed group", "email", claims.Email, "groups", claims.Groups)
+		http.Error(w, "not a member of an allowed group", http.StatusForbidden)
+		return
+	}
+
+	sessionID, err := randomID()
+	if err != nil {
+		http.Error(w, "login failed", http.StatusInternalServerError)
+		return
+	}
+	if err := g.saveSession(sessionID, oidcSession{
+		Email:  claims.Email,
+		Groups: claims.Groups,
+		Expiry: time.Now().Add(oidcSessionTTL),
+	}); err != nil {
+		slog.Error("could not persist oidc session", "error", err)
+		http.Error(w, "login failed", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, g.cookie(sessionID, oidcSessionTTL))
+
+	redirectTo := state.RedirectURL
+	if redirectTo == "" {
+		redirectTo = "/"
+	}
+	http.Redirect(w, r, redirectTo, http.StatusFound)
+}
+
+func (g *oidcGateway) serveLogout(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(oidcCookieName); err == nil {
+		if id, ok := g.verifyCookieValue(c.Value); ok {
+			os.Remove(g.sessionPath(id))
+		}
+	}
+	http.SetCookie(w, g.cookie("", -1))
+	fmt.Fprintln(w, "Logged out.")
+}
+
+func (g *oidcGateway) anyGroupAllowed(groups []string) bool {
+	for _, group := range groups {
+		if g.allowedGroups[group] {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *oidcGateway) cookie(sessionID string, ttl time.Duration) *http.Cookie {
+	value := ""
+	if sessionID != "" {
+		value = g.signCookieValue(sessionID)
+	}
+	c := &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if ttl > 0 {
+		c.Expires = time.Now().Add(ttl)
+	} else {
+		c.MaxAge = -1
+	}
+	return c
+}
+
+func (g *oidcGateway) signCookieValue(sessionID string) string {
+	mac := hmac.New(sha256.New, g.hmacKey)
+	mac.Write([]byte(sessionID))
+	sig := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	return sessionID + "." + sig
+}
+
+func (g *oidcGateway) verifyCookieValue(value string) (string, bool) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+	expected := g.signCookieValue(parts[0])
+	if !hmac.Equal([]byte(expected), []byte(value)) {
+		return "", false
+	}
+	return parts[0], true
+}
+
+func (g *oidcGateway) sessionFromRequest(r *http.Request) (*oidcSession, error) {
+	c, err := r.Cookie(oidcCookieName)
+	if err != nil {
+		return nil, err
+	}
+	id, ok := g.verifyCookieValue(c.Value)
+	if !ok {
+		return nil, errors.New("invalid session cookie")
+	}
+	var session oidcSession
+	if err := readJSONFile(g.sessionPath(id), &session); err != nil {
+		return nil, err
+	}
+	if time.Now().After(session.Expiry) {
+		os.Remove(g.sessionPath(id))
+		return nil, errors.New("session expired")
+	}
+	return &session, nil
+}
+
+func (g *oidcGateway) saveSession(id string, session oidcSession) error {
+	return writeJSONFile(g.sessionPath(id), session)
+}
+
+func (g *oidcGateway) sessionPath(id string) string {
+	return filepath.Join(g.dir, "session-"+id+".json")
+}
+
+func (g *oidcGateway) saveState(id string, state oidcState) error {
+	return writeJSONFile(g.statePath(id), state)
+}
+
+func (g *oidcGateway) loadState(id string) (*oidcState, error) {
+	if id == "" {
+		return nil, errors.New("missing state parameter")
+	}
+	var state oidcState
+	if err := readJSONFile(g.statePath(id), &state); err != nil {
+		return nil, err
+	}
+	os.Remove(g.statePath(id))
+	if time.Now().After(state.Expiry) {
+		return nil, errors.New("state expired")
+	}
+	return &state, nil
+}
+
+func (g *oidcGateway) statePath(id string) string {
+	return filepath.Join(g.dir, "state-"+id+".json")
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func writeJSONFile(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+func readJSONFile(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// remoteAddrContextKey is set on each accepted connection's request context
+// via http.Server.ConnContext so that the dialer wrapper below can recover
+// the real tailnet client address, even though it only sees the address of
+// the upstream dial.
+type remoteAddrContextKey struct{}
+
+// proxyProtocolDialer wraps dial so that, on every new connection, it writes
+// a PROXY protocol header (v1 or v2, per s.ProxyProtocol) carrying the
+// client's tailnet address before any HTTP bytes are sent. The caller must
+// also disable transport connection reuse, since the header is only valid
+// as the very first bytes of a fresh connection.
+func (s *validTailnetSrv) proxyProtocolDialer(dial func(context.Context, string, string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		src, _ := ctx.Value(remoteAddrContextKey{}).(net.Addr)
+		if src == nil {
+			src = conn.LocalAddr()
+		}
+		header, err := proxyProtocolHeader(s.ProxyProtocol, src, conn.LocalAddr())
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("building proxy protocol header: %w", err)
+		}
+		if _, err := conn.Write(header); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("writing proxy protocol header: %w", err)
+		}
+		return conn, nil
+	}
+}
+
+func proxyProtocolHeader(version string, src, dst net.Addr) ([]byte, error) {
+	srcTCP, ok := src.(*net.TCPAddr)
+	if !ok {
+		srcTCP = &net.TCPAddr{IP: net.IPv4zero, Port: 0}
+	}
+	dstTCP, ok := dst.(*net.TCPAddr)
+	if !ok {
+		dstTCP = &net.TCPAddr{IP: net.IPv4zero, Port: 0}
+	}
+	switch version {
+	case "v1":
+		return proxyProtocolV1Header(srcTCP, dstTCP), nil
+	case "v2":
+		return proxyProtocolV2Header(srcTCP, dstTCP), nil
+	default:
+		return nil, fmt.Errorf("unknown proxy protocol version %#v", version)
+	}
+}
+
+func proxyProtocolV1Header(src, dst *net.TCPAddr) []byte {
+	family := "TCP4"
+	if src.IP.To4() == nil {
+		family = "TCP6"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, src.IP.String(), dst.IP.String(), src.Port, dst.Port))
+}
+
+var proxyProtocolV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// proxyProtocolV2Header builds a PROXY protocol v2 binary header (PROXY,
+// version 2, command PROXY, address family TCP4/TCP6) as specified by
+// https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt.
+func proxyProtocolV2Header(src, dst *net.TCPAddr) []byte {
+	v4 := src.IP.To4() != nil
+	var addrFamily byte = 0x11 // AF_INET << 4 | STREAM
+	addrLen := 12
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if !v4 {
+		addrFamily = 0x21 // AF_INET6 << 4 | STREAM
+		addrLen = 36
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+	buf := make([]byte, 0, len(proxyProtocolV2Signature)+4+addrLen)
+	buf = append(buf, proxyProtocolV2Signature...)
+	buf = append(buf, 0x21) // version 2, command PROXY
+	buf = append(buf, addrFamily)
+	lenBuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(lenBuf, uint16(addrLen))
+	buf = append(buf, lenBuf...)
+	buf = append(buf, srcIP...)
+	buf = append(buf, dstIP...)
+	portBuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBuf, uint16(src.Port))
+	buf = append(buf, portBuf...)
+	binary.BigEndian.PutUint16(portBuf, uint16(dst.Port))
+	buf = append(buf, portBuf...)
+	return buf
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/store"
+	"tailscale.com/types/logger"
+)
+
+// buildStateStore turns a -stateStore URL into an ipn.StateStore for
+// tsnet.Server.Store. "dir://<path>" keeps state in <path>/tailscaled.state,
+// the same file tsnet uses under -stateDir; "mem://"/"kube://" are translated
+// into the single-colon scheme tailscale's own store.New expects before being
+// handed to it; "file+aes://" is tsnsrv's own scheme for a symmetric-encrypted
+// state file, for stateless containers that can't use a Kubernetes Secret.
+func buildStateStore(raw string) (ipn.StateStore, error) {
+	if strings.HasPrefix(raw, "file+aes://") {
+		return newAESFileStore(raw)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -stateStore URL %v: %w", raw, err)
+	}
+	switch u.Scheme {
+	case "dir":
+		return store.New(logger.Discard, filepath.Join(u.Host+u.Path, "tailscaled.state"))
+	case "mem":
+		return store.New(logger.Discard, "mem:")
+	case "kube":
+		return store.New(logger.Discard, "kube:"+u.Host)
+	default:
+		return store.New(logger.Discard, raw)
+	}
+}
+
+// resolveSecretURL resolves a secret from one of the schemes shared with
+// -stateStore: env://VAR reads an environment variable, file://path reads a
+// plain file, kube://<secret-name>/<key> reads the given key of a Kubernetes
+// secret (via the same client tailscale's kube store uses; key defaults to
+// "authkey" if omitted), and file+aes://<path> reads a single value out of
+// an encrypted state store keyed by "authkey".
+func resolveSecretURL(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid secret URL %v: %w", raw, err)
+	}
+	switch u.Scheme {
+	case "env":
+		val, ok := os.LookupEnv(u.Host)
+		if !ok {
+			return "", fmt.Errorf("environment variable %v is not set", u.Host)
+		}
+		return val, nil
+	case "file":
+		data, err := os.ReadFile(u.Host + u.Path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	case "kube":
+		st, err := store.New(logger.Discard, "kube:"+u.Host)
+		if err != nil {
+			return "", err
+		}
+		key := strings.TrimPrefix(u.Path, "/")
+		if key == "" {
+			key = "authkey"
+		}
+		bs, err := st.ReadState(ipn.StateKey(key))
+		if err != nil {
+			return "", err
+		}
+		return string(bs), nil
+	case "file+aes":
+		st, err := newAESFileStore(raw)
+		if err != nil {
+			return "", err
+		}
+		bs, err := st.ReadState(ipn.StateKey("authkey"))
+		if err != nil {
+			return "", err
+		}
+		return string(bs), nil
+	default:
+		return "", fmt.Errorf("unknown secret URL scheme %#v", u.Scheme)
+	}
+}
+
+// aesFileStore is an ipn.StateStore backed by a single AES-GCM encrypted
+// file, so tsnet state can be persisted to an ordinary volume or bind mount
+// without it being readable at rest.
+type aesFileStore struct {
+	path string
+	key  [32]byte
+
+	mu   sync.Mutex
+	data map[ipn.StateKey][]byte
+}
+
+func newAESFileStore(raw string) (*aesFileStore, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid file+aes store URL %v: %w", raw, err)
+	}
+	keySpec := u.Query().Get("key")
+	if keySpec == "" {
+		return nil, errors.New("file+aes:// store requires a ?key= parameter")
+	}
+	material, err := secretMaterial(keySpec)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve file+aes key: %w", err)
+	}
+	s := &aesFileStore{
+		path: u.Host + u.Path,
+		key:  sha256.Sum256([]byte(material)),
+		data: map[ipn.StateKey][]byte{},
+	}
+	if err := s.load(); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not load %v: %w", s.path, err)
+	}
+	return s, nil
+}
+
+// secretMaterial resolves a ?key= value that is itself one of env:/file: or
+// a literal passphrase, distinct from resolveSecretURL's full URLs since
+// query parameters can't easily carry another "://".
+func secretMaterial(spec string) (string, error) {
+	switch {
+	case strings.HasPrefix(spec, "env:"):
+		name := strings.TrimPrefix(spec, "env:")
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %v is not set", name)
+		}
+		return val, nil
+	case strings.HasPrefix(spec, "file:"):
+		data, err := os.ReadFile(strings.TrimPrefix(spec, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	default:
+		return spec, nil
+	}
+}
+
+func (s *aesFileStore) load() error {
+	raw, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	plain, err := s.decrypt(raw)
+	if err != nil {
+		return fmt.Errorf("could not decrypt %v: %w", s.path, err)
+	}
+	return json.Unmarshal(plain, &s.data)
+}
+
+func (s *aesFileStore) persist() error {
+	plain, err := json.Marshal(s.data)
+	if err != nil {
+		return err
+	}
+	sealed, err := s.encrypt(plain)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, sealed, 0600)
+}
+
+func (s *aesFileStore) gcm() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(s.key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *aesFileStore) encrypt(plain []byte) ([]byte, error) {
+	gcm, err := s.gcm()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+func (s *aesFileStore) decrypt(sealed []byte) ([]byte, error) {
+	gcm, err := s.gcm()
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+// ReadState implements ipn.StateStore.
+func (s *aesFileStore) ReadState(id ipn.StateKey) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bs, ok := s.data[id]
+	if !ok {
+		return nil, ipn.ErrStateNotExist
+	}
+	return bs, nil
+}
+
+// WriteState implements ipn.StateStore.
+func (s *aesFileStore) WriteState(id ipn.StateKey, bs []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[id] = bs
+	return s.persist()
+}
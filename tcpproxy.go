@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+var (
+	tcpConnsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tsnsrv_tcp_connections_total",
+		Help: "Total number of TCP proxy connections accepted, by outcome.",
+	}, []string{"name", "outcome"})
+	tcpBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tsnsrv_tcp_bytes_total",
+		Help: "Total bytes spliced by the TCP proxy, by direction.",
+	}, []string{"name", "direction"})
+	tcpConnDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "tsnsrv_tcp_connection_duration_seconds",
+		Help: "Duration of TCP proxy connections.",
+	}, []string{"name"})
+)
+
+// TCPACLHook, if set, is consulted for every accepted connection in -mode=tcp
+// before dialing upstream. Returning an error rejects the connection; whois
+// may be nil if the lookup failed or was suppressed.
+type TCPACLHook func(whois *apitype.WhoIsResponse, remoteAddr net.Addr) error
+
+// runTCP accepts raw connections from l and splices them to
+// DownstreamTCPAddr/DownstreamUnixAddr, logging the tailnet identity of each
+// client. It blocks until l is closed or ctx is canceled.
+func (s *validTailnetSrv) runTCP(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("accept: %w", err)
+		}
+		go s.handleTCPConn(ctx, conn)
+	}
+}
+
+func (s *validTailnetSrv) handleTCPConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	timer := prometheus.NewTimer(tcpConnDuration.WithLabelValues(s.Name))
+	defer timer.ObserveDuration()
+
+	var whois *apitype.WhoIsResponse
+	if s.client != nil && !s.SuppressWhois {
+		whoisCtx, cancel := context.WithTimeout(ctx, s.WhoisTimeout)
+		w, err := s.client.WhoIs(whoisCtx, conn.RemoteAddr().String())
+		cancel()
+		if err != nil {
+			slog.Warn("could not look up whois for tcp client", "remoteAddr", conn.RemoteAddr(), "error", err)
+		} else {
+			whois = w
+		}
+	}
+
+	if s.TCPACLHook != nil {
+		if err := s.TCPACLHook(whois, conn.RemoteAddr()); err != nil {
+			slog.Warn("rejected tcp connection by ACL hook", "remoteAddr", conn.RemoteAddr(), "error", err)
+			tcpConnsTotal.WithLabelValues(s.Name, "rejected").Inc()
+			return
+		}
+	}
+
+	upstream := s.DownstreamTCPAddr
+	network := "tcp"
+	if s.DownstreamUnixAddr != "" {
+		upstream = s.DownstreamUnixAddr
+		network = "unix"
+	}
+	var d net.Dialer
+	up, err := d.DialContext(ctx, network, upstream)
+	if err != nil {
+		slog.Error("could not dial upstream", "upstream", upstream, "error", err)
+		tcpConnsTotal.WithLabelValues(s.Name, "dial_error").Inc()
+		return
+	}
+	defer up.Close()
+
+	if s.ProxyProtocol != "" {
+		header, err := proxyProtocolHeader(s.ProxyProtocol, conn.RemoteAddr(), up.LocalAddr())
+		if err != nil {
+			slog.Error("could not build proxy protocol header", "error", err)
+			tcpConnsTotal.WithLabelValues(s.Name, "proxy_protocol_error").Inc()
+			return
+		}
+		if _, err := up.Write(header); err != nil {
+			slog.Error("could not write proxy protocol header", "error", err)
+			tcpConnsTotal.WithLabelValues(s.Name, "proxy_protocol_error").Inc()
+			return
+		}
+	}
+
+	logAttrs := []any{
+		"remoteAddr", conn.RemoteAddr(),
+		"upstream", upstream,
+	}
+	if whois != nil && whois.UserProfile != nil {
+		logAttrs = append(logAttrs, "tailscaleUser", whois.UserProfile.LoginName)
+	}
+	if whois != nil && whois.Node != nil {
+		logAttrs = append(logAttrs, "tailscaleNode", whois.Node.Name)
+	}
+	slog.Info("tcp connection accepted", logAttrs...)
+	tcpConnsTotal.WithLabelValues(s.Name, "accepted").Inc()
+
+	errc := make(chan error, 2)
+	go func() {
+		n, err := io.Copy(up, conn)
+		tcpBytesTotal.WithLabelValues(s.Name, "upstream").Add(float64(n))
+		errc <- err
+	}()
+	go func() {
+		n, err := io.Copy(conn, up)
+		tcpBytesTotal.WithLabelValues(s.Name, "downstream").Add(float64(n))
+		errc <- err
+	}()
+	<-errc
+}
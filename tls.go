@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/exp/slog"
+)
+
+// wrapExternalTLS terminates TLS on top of a plain listener using either an
+// ACME-issued certificate (-tls=letsencrypt) or a PEM cert/key pair
+// (-tls=file), instead of relying on the Tailscale-issued *.ts.net
+// certificate from tsnet.ListenTLS. ctx bounds the lifetime of any
+// additional listeners opened along the way (e.g. the ACME http-01
+// challenge listener), so they get closed on reload/shutdown too.
+func (s *TailnetSrv) wrapExternalTLS(ctx context.Context, raw net.Listener) (net.Listener, error) {
+	switch s.TLSMode {
+	case "letsencrypt":
+		return s.autocertListener(ctx, raw)
+	case "file":
+		return s.fileTLSListener(raw)
+	default:
+		return nil, fmt.Errorf("unknown -tls mode %#v", s.TLSMode)
+	}
+}
+
+func (s *TailnetSrv) autocertListener(ctx context.Context, raw net.Listener) (net.Listener, error) {
+	mgr := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(s.TLSHostname),
+		Cache:      autocert.DirCache(filepath.Join(s.StateDir, "acme")),
+	}
+	if s.ACMEChallenge == "http-01" {
+		challengeListener, err := net.Listen("tcp", ":80")
+		if err != nil {
+			return nil, fmt.Errorf("could not listen on :80 for acme http-01 challenge: %w", err)
+		}
+		go func() {
+			<-ctx.Done()
+			challengeListener.Close()
+		}()
+		go func() {
+			if err := http.Serve(challengeListener, mgr.HTTPHandler(nil)); err != nil && ctx.Err() == nil {
+				slog.Error("acme http-01 challenge listener failed", "error", err)
+			}
+		}()
+	}
+	return tls.NewListener(raw, mgr.TLSConfig()), nil
+}
+
+func (s *TailnetSrv) fileTLSListener(raw net.Listener) (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(s.TLSCertFile, s.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load TLS cert/key: %w", err)
+	}
+	return tls.NewListener(raw, &tls.Config{Certificates: []tls.Certificate{cert}}), nil
+}